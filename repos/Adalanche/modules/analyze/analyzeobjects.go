@@ -1,7 +1,7 @@
 package analyze
 
 import (
-	"sort"
+	"runtime"
 	"strconv"
 
 	"github.com/gin-gonic/gin"
@@ -10,7 +10,6 @@ import (
 	"github.com/lkarlslund/adalanche/modules/query"
 	"github.com/lkarlslund/adalanche/modules/ui"
 	"github.com/lkarlslund/adalanche/modules/util"
-	"github.com/lkarlslund/adalanche/modules/windowssecurity"
 )
 
 var SortBy engine.Attribute = engine.NonExistingAttribute
@@ -29,6 +28,7 @@ func NewAnalyzeObjectsOptions() AnalyzeOptions {
 		MinAccumulatedProbability: 0,
 		PruneIslands:              false,
 		DontExpandAUEO:            true,
+		Workers:                   runtime.NumCPU(),
 	}
 }
 
@@ -49,10 +49,25 @@ type AnalyzeOptions struct {
 	Backlinks                 int // Backlink depth
 	MinEdgeProbability        engine.Probability
 	MinAccumulatedProbability engine.Probability
+	MinInstances              int // Require at least this many EdgeInstance records backing an edge
 	PruneIslands              bool
 	DontExpandAUEO            bool
 	AllDetails                bool
 	NodeLimit                 int
+
+	// PathMode switches Analyze from "all reachable" BFS expansion to returning
+	// the PathCount most-probable paths from FilterFirst to Targets
+	PathMode  PathMode
+	Targets   query.NodeFilter
+	PathCount int
+
+	// Collections holds additional directories (e.g. a connected Azure/Entra
+	// tenant) to analyze alongside the primary Objects given to Analyze
+	Collections []*engine.Objects
+
+	// Workers is the number of goroutines used to evaluate a round's nodes
+	// concurrently. 0 or 1 processes the round serially
+	Workers int
 }
 
 func ParseQueryFromPOST(ctx *gin.Context, objects *engine.Objects) (*AnalyzeOptions, error) {
@@ -80,6 +95,38 @@ func ParseQueryFromPOST(ctx *gin.Context, objects *engine.Objects) (*AnalyzeOpti
 		aoo.NodeLimit, _ = strconv.Atoi(nodelimit)
 	}
 
+	// Top-K shortest path mode: instead of expanding everything reachable from
+	// FilterFirst, return the PathCount most-probable paths to Targets
+	if pathmode, ok := params["pathmode"].(string); ok && pathmode == "topk" {
+		aoo.PathMode = PathModeTopK
+	}
+	if pathcount, ok := params["pathcount"].(string); ok {
+		aoo.PathCount, _ = strconv.Atoi(pathcount)
+	}
+	if targetsquery, ok := params["targets"].(string); ok && targetsquery != "" {
+		// Same LDAP-style filter syntax as qd.QueryStart, just aimed at a
+		// separate set of objects (the path destinations) instead of FilterFirst
+		targetfilter, err := query.ParseLDAPQuery(targetsquery, objects)
+		if err != nil {
+			return nil, err
+		}
+		aoo.Targets = targetfilter
+	}
+
+	// Run the requested registered post-processors (memberof-transitive,
+	// groupbyordinal, ...) against the loaded objects before we analyze
+	if rawpostprocessors, ok := params["postprocessors"].([]any); ok {
+		var names []string
+		for _, raw := range rawpostprocessors {
+			if name, ok := raw.(string); ok {
+				names = append(names, name)
+			}
+		}
+		if len(names) > 0 {
+			RunPostProcessors(objects, names)
+		}
+	}
+
 	// tricky tricky - if we get a call with the expanddn set, then we handle things .... differently :-)
 	// if expanddn := params["expanddn"]; expanddn != "" {
 	// 	qd.QueryStart = `(distinguishedName=` + expanddn + `)`
@@ -96,16 +143,17 @@ func ParseQueryFromPOST(ctx *gin.Context, objects *engine.Objects) (*AnalyzeOpti
 		aoo.EdgesLast = engine.AllEdgesBitmap
 	}
 
-	// Parse object types into map of objectType
-	aoo.ObjectTypesFirst, err = ParseObjectTypeStrings(qd.ObjectTypesFirst)
+	// Parse object types into map of objectType, stripping any "ad:"/"azure:"
+	// namespace prefix first so cross-directory queries can use them
+	aoo.ObjectTypesFirst, err = ParseObjectTypeStrings(stripNamespaces(qd.ObjectTypesFirst))
 	if err != nil {
 		return nil, err
 	}
-	aoo.ObjectTypesMiddle, err = ParseObjectTypeStrings(qd.ObjectTypesMiddle)
+	aoo.ObjectTypesMiddle, err = ParseObjectTypeStrings(stripNamespaces(qd.ObjectTypesMiddle))
 	if err != nil {
 		return nil, err
 	}
-	aoo.ObjectTypesLast, err = ParseObjectTypeStrings(qd.ObjectTypesLast)
+	aoo.ObjectTypesLast, err = ParseObjectTypeStrings(stripNamespaces(qd.ObjectTypesLast))
 	if err != nil {
 		return nil, err
 	}
@@ -119,10 +167,6 @@ type GraphNode struct {
 	accumulatedprobability float32 // 0-1
 }
 
-type PostProcessorFunc func(pg graph.Graph[*engine.Object, engine.EdgeBitmap]) graph.Graph[*engine.Object, engine.EdgeBitmap]
-
-var PostProcessors []PostProcessorFunc
-
 // type AnalysisNode struct {
 // 	*engine.Object
 // 	engine.DynamicFields
@@ -134,26 +178,33 @@ type AnalysisResults struct {
 }
 
 func Analyze(opts AnalyzeOptions, objects *engine.Objects) AnalysisResults {
+	if opts.PathMode == PathModeTopK {
+		return analyzeTopKPaths(opts, objects)
+	}
 
 	pg := graph.NewGraph[*engine.Object, engine.EdgeBitmap]()
 	extrainfo := make(map[*engine.Object]*GraphNode)
 
-	// Convert to our working graph
+	// Convert to our working graph, querying the primary collection plus any
+	// extra ones given in opts.Collections (e.g. a connected Azure/Entra tenant)
 	currentRound := 1
-	query.Execute(opts.FilterFirst, objects).Iterate(func(o *engine.Object) bool {
-		pg.SetNodeData(o, "target", true)
-
-		for o := range pg.Nodes() {
-			if ei, found := extrainfo[o]; !found || ei.processRound == 0 {
-				extrainfo[o] = (&GraphNode{
-					processRound:           currentRound,
-					accumulatedprobability: 1,
-				})
+	for _, collection := range allCollections(objects, opts.Collections) {
+		query.Execute(opts.FilterFirst, collection).Iterate(func(o *engine.Object) bool {
+			o = canonicalIdentity(o)
+			pg.SetNodeData(o, "target", true)
+
+			for o := range pg.Nodes() {
+				if ei, found := extrainfo[o]; !found || ei.processRound == 0 {
+					extrainfo[o] = (&GraphNode{
+						processRound:           currentRound,
+						accumulatedprobability: 1,
+					})
+				}
 			}
-		}
 
-		return true
-	})
+			return true
+		})
+	}
 
 	// Methods and ObjectTypes allowed
 	detectedges := opts.EdgesFirst
@@ -174,171 +225,26 @@ func Analyze(opts AnalyzeOptions, objects *engine.Objects) AnalysisResults {
 
 		nodesatstartofround := pg.Order()
 
+		var roundnodes []*engine.Object
 		for currentobject := range pg.Nodes() {
 			// All nodes need to be processed in the next round
-			ei := extrainfo[currentobject]
-
-			if ei.processRound != currentRound /* shouldn't be processed this round */ {
-				continue
+			if extrainfo[currentobject].processRound == currentRound {
+				roundnodes = append(roundnodes, currentobject)
 			}
+		}
 
-			newconnectionsmap := make(map[graph.NodePair[*engine.Object]]engine.EdgeBitmap) // Pwn Connection between objects
-
-			if opts.Direction == engine.In && opts.DontExpandAUEO && (currentobject.SID() == windowssecurity.EveryoneSID || currentobject.SID() == windowssecurity.AuthenticatedUsersSID) {
-				// Don't expand Authenticated Users or Everyone
-				continue
-			}
-
-			// Iterate over ever edges
-			currentobject.Edges(opts.Direction).Range(func(nextobject *engine.Object, eb engine.EdgeBitmap) bool {
-				// If this is not a chosen edge, skip it
-				detectededges := eb.Intersect(detectedges)
-
-				if detectededges.IsBlank() {
-					// Nothing useful or just a deny ACL, skip it
-					return true // continue
-				}
-
-				if detectobjecttypes != nil {
-					if _, found := detectobjecttypes[nextobject.Type()]; !found {
-						// We're filtering on types, and it's not wanted
-						return true //continue
-					}
-				}
-
-				// Edge probability
-				var maxprobability engine.Probability
-				if opts.Direction == engine.In {
-					maxprobability = detectededges.MaxProbability(nextobject, currentobject)
-				} else {
-					maxprobability = detectededges.MaxProbability(currentobject, nextobject)
-				}
-				if maxprobability < engine.Probability(opts.MinEdgeProbability) {
-					// Too unlikeliy, so we skip it
-					return true // continue
-				}
-
-				// Accumulated node probability
-				accumulatedprobability := ei.accumulatedprobability * float32(maxprobability) / 100
-				if accumulatedprobability < float32(opts.MinAccumulatedProbability)/100 {
-					// Too unlikeliy, so we skip it
-					return true // continue
-				}
-
-				// If we allow backlinks, all pwns are mapped, no matter who is the victim
-				// Targets are allowed to pwn each other as a way to reach the goal of pwning all of them
-				// If pwner is already processed, we don't care what it can pwn someone more far away from targets
-				// If pwner is our attacker, we always want to know what it can do
-				found := pg.HasNode(nextobject) // It could JUST have been added to the graph by another node in current processing round though
-
-				// SKIP THIS IF
-				if
-				// We're not including backlinks
-				found &&
-					// This is not the first round
-					currentRound > 1 &&
-					// It was found in an earlier round
-					extrainfo[nextobject] != nil && extrainfo[nextobject].processRound+opts.Backlinks <= currentRound &&
-					// If SIDs match between objects, it's a cross forest/domain link and we want to see it
-					(currentobject.SID().IsNull() || nextobject.SID().IsNull() || currentobject.SID().Component(2) != 21 || currentobject.SID() != nextobject.SID()) {
-					// skip it
-					return true // continue
-				}
-
-				if opts.FilterMiddle != nil && !opts.FilterMiddle.Evaluate(nextobject) {
-					// skip unwanted middle objects
-					return true // continue
-				}
-
-				if opts.Direction == engine.In {
-					newconnectionsmap[graph.NodePair[*engine.Object]{
-						Source: nextobject,
-						Target: currentobject}] = detectededges
-				} else {
-					newconnectionsmap[graph.NodePair[*engine.Object]{
-						Source: currentobject,
-						Target: nextobject}] = detectededges
-				}
-
-				if currentRound != 1 || extrainfo[nextobject] == nil {
-					// First round is special, as we process the targets
-					// All the other rounds, we can assume that nextobjects are new in the graph
-					extrainfo[nextobject] = &GraphNode{
-						processRound:           currentRound + 1,
-						accumulatedprobability: ei.accumulatedprobability * float32(maxprobability) / 100,
-					}
-				}
-
-				return true
-			})
-
-			if opts.MaxOutgoingConnections == -1 || len(newconnectionsmap) < opts.MaxOutgoingConnections {
-				for pwnpair, detectedmethods := range newconnectionsmap {
-					pg.AddEdge(pwnpair.Source, pwnpair.Target, detectedmethods)
-				}
-				// Add pwn target to graph for processing
-			} else {
-				ui.Debug().Msgf("Outgoing expansion limit hit %v for object %v, there was %v connections", opts.MaxOutgoingConnections, currentobject.Label(), len(newconnectionsmap))
-				var added int
-				var groupcount int
-				for _, detectedmethods := range newconnectionsmap {
-					// We assume the number of groups are limited and add them anyway
-					if detectedmethods.IsSet(EdgeMemberOfGroup) {
-						groupcount++
-					}
-				}
-
-				if groupcount < opts.MaxOutgoingConnections {
-					// Add the groups, but not the rest
-					for pwnpair, detectedmethods := range newconnectionsmap {
-						// We assume the number of groups are limited and add them anyway
-						if detectedmethods.IsSet(EdgeMemberOfGroup) {
-							pg.AddEdge(pwnpair.Source, pwnpair.Target, detectedmethods)
-							delete(newconnectionsmap, pwnpair)
-							added++
-						}
-					}
-					ui.Debug().Msgf("Expansion limit compromise - added %v groups as they fit under the expansion limit %v", added, opts.MaxOutgoingConnections)
-				}
-
-				// Add some more to expansion limit hit objects if we know how
-				if SortBy != engine.NonExistingAttribute {
-					var additionaladded int
-
-					// Find the most important ones that are not groups
-					var notadded []graph.GraphNodePairEdge[*engine.Object, engine.EdgeBitmap]
-					for pwnpair, detectedmethods := range newconnectionsmap {
-						notadded = append(notadded, graph.GraphNodePairEdge[*engine.Object, engine.EdgeBitmap]{
-							Source: pwnpair.Source,
-							Target: pwnpair.Target,
-							Edge:   detectedmethods,
-						})
-					}
-
-					if SortBy != engine.NonExistingAttribute {
-						sort.Slice(notadded, func(i, j int) bool {
-							if opts.Direction == engine.In {
-								iv, _ := notadded[i].Source.AttrInt(SortBy)
-								jv, _ := notadded[j].Source.AttrInt(SortBy)
-								return iv > jv
-							}
-							iv, _ := notadded[i].Target.AttrInt(SortBy)
-							jv, _ := notadded[j].Target.AttrInt(SortBy)
-							return iv > jv
-						})
-					}
-
-					// Add up to limit
-					for i := 0; i+added < opts.MaxOutgoingConnections && i < len(notadded); i++ {
-						pg.AddEdge(notadded[i].Source, notadded[i].Target, notadded[i].Edge)
-						additionaladded++
-					}
+		if opts.Workers > 1 {
+			processRoundParallel(opts, pg, extrainfo, currentRound, detectedges, detectobjecttypes, roundnodes)
+		} else {
+			for _, currentobject := range roundnodes {
+				ei := extrainfo[currentobject]
 
-					ui.Debug().Msgf("Added additionally %v prioritized objects", additionaladded)
-					added += additionaladded
+				if skipExpansion(opts, currentobject) {
+					continue
 				}
 
-				ei.CanExpand = len(newconnectionsmap) - added
+				newconnectionsmap, discovered := evaluateNode(opts, pg, extrainfo, currentRound, detectedges, detectobjecttypes, currentobject, ei)
+				applyNodeResult(pg, ei, currentobject, opts, currentRound, newconnectionsmap, discovered, extrainfo)
 			}
 		}
 		ui.Debug().Msgf("Processing round %v yielded %v new objects", currentRound, pg.Order()-nodesatstartofround)
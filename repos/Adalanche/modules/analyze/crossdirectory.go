@@ -0,0 +1,85 @@
+package analyze
+
+import (
+	"strings"
+
+	"github.com/lkarlslund/adalanche/modules/engine"
+)
+
+// EdgeSyncedToCloud and EdgeSyncedFromOnPrem are the connector edges linking a
+// hybrid identity's on-prem AD object to its Entra ID counterpart
+var (
+	EdgeSyncedToCloud    = engine.NewEdge("SyncedToCloud")
+	EdgeSyncedFromOnPrem = engine.NewEdge("SyncedFromOnPrem")
+)
+
+// allCollections returns the primary Objects collection plus any extra
+// collections configured on AnalyzeOptions, so callers can run a single query
+// across an on-prem AD forest and a connected Azure/Entra tenant at once
+func allCollections(primary *engine.Objects, extra []*engine.Objects) []*engine.Objects {
+	collections := make([]*engine.Objects, 0, len(extra)+1)
+	collections = append(collections, primary)
+	collections = append(collections, extra...)
+	return collections
+}
+
+// canonicalIdentity collapses a hybrid identity onto its on-prem AD object
+// when one exists, so a node synced between directories is expanded only
+// once instead of once per directory it appears in. Checks both directions
+// of the connector edge, since a connector may only emit the edge from the
+// on-prem side (EdgeSyncedToCloud) rather than the Entra side
+// (EdgeSyncedFromOnPrem)
+func canonicalIdentity(o *engine.Object) *engine.Object {
+	var canonical *engine.Object
+	o.Edges(engine.Out).Range(func(target *engine.Object, eb engine.EdgeBitmap) bool {
+		if eb.IsSet(EdgeSyncedFromOnPrem) {
+			canonical = target
+			return false // found it, stop iterating
+		}
+		return true
+	})
+	if canonical != nil {
+		return canonical
+	}
+	o.Edges(engine.In).Range(func(source *engine.Object, eb engine.EdgeBitmap) bool {
+		if eb.IsSet(EdgeSyncedToCloud) {
+			canonical = source
+			return false // found it, stop iterating
+		}
+		return true
+	})
+	if canonical != nil {
+		return canonical
+	}
+	return o
+}
+
+// ParseNamespacedObjectType splits a namespace-qualified object type such as
+// "ad:User" or "azure:ServicePrincipal" into its namespace and type name.
+// Types without a namespace prefix are returned with an empty namespace,
+// which callers should treat as "the primary collection's own namespace".
+// The namespace is currently discarded rather than resolved against -
+// ParseObjectTypeStrings only knows plain type names, so an "ad:User" and an
+// "azure:User" both end up looked up as plain "User" and are not
+// disambiguated between directories
+func ParseNamespacedObjectType(s string) (namespace, objecttype string) {
+	if ns, rest, found := strings.Cut(s, ":"); found {
+		return ns, rest
+	}
+	return "", s
+}
+
+// stripNamespaces removes the namespace prefix (if any) from every type
+// string, so ParseObjectTypeStrings - which only knows plain type names -
+// can resolve a namespace-qualified type like "ad:User" or
+// "azure:ServicePrincipal" coming from a cross-directory query. This drops
+// the namespace rather than using it, so it does not disambiguate types of
+// the same name between connected directories - only strips what would
+// otherwise be an unrecognized prefix
+func stripNamespaces(types []string) []string {
+	stripped := make([]string, len(types))
+	for i, t := range types {
+		_, stripped[i] = ParseNamespacedObjectType(t)
+	}
+	return stripped
+}
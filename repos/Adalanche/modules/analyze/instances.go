@@ -0,0 +1,119 @@
+package analyze
+
+import (
+	"sync"
+
+	"github.com/lkarlslund/adalanche/modules/engine"
+	"github.com/lkarlslund/adalanche/modules/graph"
+)
+
+// EdgeInstance is one concrete fact backing an edge between two objects - e.g.
+// a specific ACE granting WriteDACL, or a specific certificate template
+// enabling ESC1 - so the UI can enumerate which ACE/template/session backs a
+// rendered edge instead of just the collapsed EdgeBitmap bit. The ordinal
+// concept is borrowed from Kythe's edge model
+type EdgeInstance struct {
+	Kind    engine.Edge
+	Ordinal uint32
+	Context any
+}
+
+var (
+	edgeInstancesMutex sync.RWMutex
+	edgeInstances      = make(map[graph.NodePair[*engine.Object]][]EdgeInstance)
+)
+
+// RegisterEdgeInstance records one more fact backing the edge from source to
+// target, assigning it the next ordinal for that pair. Loaders (the ACL
+// parser, cert template parser, session parser, ...) call this alongside
+// setting the corresponding EdgeBitmap bit, so the bitmap stays the fast path
+// and the ordinal list is only consulted when the detail is actually needed
+func RegisterEdgeInstance(source, target *engine.Object, kind engine.Edge, context any) EdgeInstance {
+	edgeInstancesMutex.Lock()
+	defer edgeInstancesMutex.Unlock()
+
+	key := graph.NodePair[*engine.Object]{Source: source, Target: target}
+	instance := EdgeInstance{
+		Kind:    kind,
+		Ordinal: uint32(len(edgeInstances[key])) + 1,
+		Context: context,
+	}
+	edgeInstances[key] = append(edgeInstances[key], instance)
+	return instance
+}
+
+// EdgeInstances returns every fact recorded for the edge from source to
+// target, in the order they were registered
+func EdgeInstances(source, target *engine.Object) []EdgeInstance {
+	edgeInstancesMutex.RLock()
+	defer edgeInstancesMutex.RUnlock()
+
+	return edgeInstances[graph.NodePair[*engine.Object]{Source: source, Target: target}]
+}
+
+// GroupByOrdinalPostProcessor returns a post-processor that deletes any edge
+// kind between two objects that has at least one but fewer than min
+// registered EdgeInstance records - e.g. keeping only CanRDP edges backed by
+// >=2 independent sessions. Edges with no registered EdgeInstance at all are
+// not looked at and are left in place. It returns the number of edge kinds it
+// deleted. Only pairs whose source belongs to objects are
+// considered, so running this against one loaded collection doesn't delete
+// edges belonging to an unrelated collection that happens to share the
+// package-level edgeInstances map
+func GroupByOrdinalPostProcessor(min int) PostProcessorFunc {
+	return func(objects *engine.Objects) int {
+		members := make(map[*engine.Object]struct{})
+		objects.Iterate(func(o *engine.Object) bool {
+			members[o] = struct{}{}
+			return true
+		})
+
+		edgeInstancesMutex.RLock()
+		defer edgeInstancesMutex.RUnlock()
+
+		var removed int
+		for pair, instances := range edgeInstances {
+			if _, ours := members[pair.Source]; !ours {
+				continue
+			}
+			bykind := make(map[engine.Edge]int)
+			for _, instance := range instances {
+				bykind[instance.Kind]++
+			}
+			for kind, count := range bykind {
+				if count < min {
+					pair.Source.DeleteEdge(pair.Target, kind)
+					removed++
+				}
+			}
+		}
+		return removed
+	}
+}
+
+// ForgetEdgeInstances evicts every recorded EdgeInstance whose source belongs
+// to objects. The edgeInstances map is keyed by *engine.Object pointers that
+// outlive the collection they came from, so nothing ever reclaims an entry on
+// its own - callers that unload or reload a collection from scratch should
+// call this first, or the map grows forever and can resurrect stale instances
+// for new objects that happen to reuse a freed pointer
+func ForgetEdgeInstances(objects *engine.Objects) {
+	members := make(map[*engine.Object]struct{})
+	objects.Iterate(func(o *engine.Object) bool {
+		members[o] = struct{}{}
+		return true
+	})
+
+	edgeInstancesMutex.Lock()
+	defer edgeInstancesMutex.Unlock()
+
+	for pair := range edgeInstances {
+		if _, ours := members[pair.Source]; ours {
+			delete(edgeInstances, pair)
+		}
+	}
+}
+
+func init() {
+	RegisterPostProcessorWithDescription("groupbyordinal", "Delete edges backed by only 1 registered instance (ACE, session, template, ...); edges with no registered instances are kept", nil, GroupByOrdinalPostProcessor(2))
+}
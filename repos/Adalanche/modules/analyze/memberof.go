@@ -0,0 +1,75 @@
+package analyze
+
+import "github.com/lkarlslund/adalanche/modules/engine"
+
+// transitiveMemberOfPostProcessor synthesizes a direct MemberOfGroup edge for
+// every group an object is only indirectly a member of through other groups -
+// e.g. A MemberOf B MemberOf C becomes A MemberOf C too - mirroring how
+// BloodHound's post-processing step expands transitive group membership so
+// Analyze doesn't have to walk the whole membership chain on every query.
+//
+// For each of o's direct group memberships, one linear closure walk finds
+// every group reachable from it - O(V+E) per direct membership, using its own
+// visited set so the walk never revisits a group twice. A transitive group is
+// registered with one EdgeInstance per distinct direct membership that reaches
+// it, which keeps the number of instances bounded by o's (small) direct
+// membership count instead of the number of distinct paths through the
+// membership graph, which is exponential in diamond-shaped nesting - common
+// in real AD, where many groups nest into a handful of shared parents like
+// "Domain Users". opts.MinInstances/GroupByOrdinalPostProcessor can still use
+// this count to keep only transitive memberships reached more than one way
+func transitiveMemberOfPostProcessor(objects *engine.Objects) int {
+	var synthesized int
+
+	objects.Iterate(func(o *engine.Object) bool {
+		direct := make(map[*engine.Object]struct{})
+		o.Edges(engine.Out).Range(func(group *engine.Object, eb engine.EdgeBitmap) bool {
+			if eb.IsSet(EdgeMemberOfGroup) {
+				direct[group] = struct{}{}
+			}
+			return true
+		})
+
+		synthesizedhere := make(map[*engine.Object]struct{}) // synthesized at least once, so we only count it once
+
+		for entry := range direct {
+			visited := make(map[*engine.Object]struct{})
+
+			var walk func(current *engine.Object)
+			walk = func(current *engine.Object) {
+				current.Edges(engine.Out).Range(func(group *engine.Object, eb engine.EdgeBitmap) bool {
+					if !eb.IsSet(EdgeMemberOfGroup) || group == o {
+						return true
+					}
+					if _, seen := visited[group]; seen {
+						return true // continue, cycle guard - also bounds the walk to O(V+E)
+					}
+					visited[group] = struct{}{}
+
+					if _, isdirect := direct[group]; !isdirect {
+						if _, already := synthesizedhere[group]; !already {
+							o.EdgeTo(group, EdgeMemberOfGroup)
+							synthesizedhere[group] = struct{}{}
+							synthesized++
+						}
+						RegisterEdgeInstance(o, group, EdgeMemberOfGroup, entry)
+					}
+
+					walk(group)
+					return true
+				})
+			}
+			walk(entry)
+		}
+
+		return true
+	})
+
+	return synthesized
+}
+
+func init() {
+	// No owned kinds: MemberOfGroup edges also come from the loaders, and
+	// deleting them before the walk would leave no membership to expand
+	RegisterPostProcessorWithDescription("memberof-transitive", "Synthesize direct MemberOfGroup edges for transitive group membership", nil, transitiveMemberOfPostProcessor)
+}
@@ -0,0 +1,324 @@
+package analyze
+
+import (
+	"encoding/json"
+	"math"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lkarlslund/adalanche/modules/engine"
+	"github.com/lkarlslund/adalanche/modules/ui"
+	"github.com/lkarlslund/adalanche/modules/windowssecurity"
+)
+
+// DefaultMissionControlHalfLife is how long it takes a mission control entry
+// to decay back to half its original suppression, when no half-life is given
+const DefaultMissionControlHalfLife = 24 * time.Hour
+
+// mcEdgeKey identifies a suppressed edge by its endpoints and edge kind, so
+// marking one edge kind between two objects as not interesting doesn't also
+// suppress a different kind of edge between the same pair
+type mcEdgeKey struct {
+	Source windowssecurity.SID
+	Target windowssecurity.SID
+	Kind   engine.Edge
+}
+
+// mcEntry is one "not interesting / false positive" marker and its decay clock
+type mcEntry struct {
+	Created  time.Time
+	HalfLife time.Duration
+}
+
+// decayWeight turns an mcEntry's age into a probability multiplier: 0 right
+// after it's created (fully suppressed), rising back towards 1 (no effect)
+// with an exponential decay of the given half-life
+func decayWeight(entry mcEntry) float32 {
+	halflife := entry.HalfLife
+	if halflife <= 0 {
+		halflife = DefaultMissionControlHalfLife
+	}
+	elapsed := time.Since(entry.Created)
+	if elapsed <= 0 {
+		return 0
+	}
+	suppression := math.Pow(0.5, float64(elapsed)/float64(halflife))
+	return float32(1 - suppression)
+}
+
+// MissionControlTracker tracks edges and vertices the operator has marked as
+// "not interesting / false positive", decaying that suppression back to
+// nothing over a configurable half-life, inspired by Lightning's routing
+// mission control. Analyze consults it to multiply edge probabilities down
+// rather than hard-removing the underlying edges
+type MissionControlTracker struct {
+	mu       sync.RWMutex
+	edges    map[mcEdgeKey]mcEntry
+	vertices map[windowssecurity.SID]mcEntry
+	path     string
+}
+
+// NewMissionControlTracker creates a tracker. If path is non-empty, marks are
+// persisted there as JSON and reloaded on startup, so operator triage survives
+// restarts
+func NewMissionControlTracker(path string) *MissionControlTracker {
+	mc := &MissionControlTracker{
+		edges:    make(map[mcEdgeKey]mcEntry),
+		vertices: make(map[windowssecurity.SID]mcEntry),
+		path:     path,
+	}
+	mc.load()
+	return mc
+}
+
+// MissionControl is the process-wide tracker consulted by Analyze. Call
+// SetMissionControlPath during startup to persist it next to the object cache
+var MissionControl = NewMissionControlTracker("")
+
+// SetMissionControlPath (re)points the process-wide MissionControl tracker at
+// a persistence file, loading any marks already saved there
+func SetMissionControlPath(path string) {
+	MissionControl = NewMissionControlTracker(path)
+}
+
+// MarkEdge suppresses edges of the given kind between source and target, with
+// the suppression halving every halflife (or DefaultMissionControlHalfLife if
+// zero)
+func (mc *MissionControlTracker) MarkEdge(source, target windowssecurity.SID, kind engine.Edge, halflife time.Duration) {
+	mc.mu.Lock()
+	mc.edges[mcEdgeKey{Source: source, Target: target, Kind: kind}] = mcEntry{Created: time.Now(), HalfLife: halflife}
+	mc.mu.Unlock()
+	mc.save()
+}
+
+// MarkVertex suppresses every edge touching sid, with the suppression halving
+// every halflife (or DefaultMissionControlHalfLife if zero)
+func (mc *MissionControlTracker) MarkVertex(sid windowssecurity.SID, halflife time.Duration) {
+	mc.mu.Lock()
+	mc.vertices[sid] = mcEntry{Created: time.Now(), HalfLife: halflife}
+	mc.mu.Unlock()
+	mc.save()
+}
+
+// Weight returns the probability multiplier (0-1) Analyze should apply to an
+// edge from src to dst carrying the given edges, based on any matching edge
+// or vertex marks and how much they've decayed. Only marks whose kind is
+// actually set in edges suppress this hop - marking CanRDP as not interesting
+// between two objects must not also suppress a HasSession edge between them
+func (mc *MissionControlTracker) Weight(src, dst *engine.Object, edges engine.EdgeBitmap) float32 {
+	mc.mu.RLock()
+	defer mc.mu.RUnlock()
+
+	weight := float32(1)
+
+	srcsid, dstsid := src.SID(), dst.SID()
+	for key, entry := range mc.edges {
+		if key.Source != srcsid || key.Target != dstsid || !edges.IsSet(key.Kind) {
+			continue
+		}
+		if w := decayWeight(entry); w < weight {
+			weight = w
+		}
+	}
+	if entry, found := mc.vertices[src.SID()]; found {
+		if w := decayWeight(entry); w < weight {
+			weight = w
+		}
+	}
+	if entry, found := mc.vertices[dst.SID()]; found {
+		if w := decayWeight(entry); w < weight {
+			weight = w
+		}
+	}
+
+	return weight
+}
+
+// mcListEntry is the JSON shape returned by the GET /api/mc listing endpoint
+type mcListEntry struct {
+	Source   string `json:",omitempty"`
+	Target   string `json:",omitempty"`
+	Vertex   string `json:",omitempty"`
+	Kind     string `json:",omitempty"`
+	Created  time.Time
+	HalfLife time.Duration
+}
+
+// List returns every still-tracked edge and vertex mark, regardless of how
+// much it has decayed
+func (mc *MissionControlTracker) List() []mcListEntry {
+	mc.mu.RLock()
+	defer mc.mu.RUnlock()
+
+	entries := make([]mcListEntry, 0, len(mc.edges)+len(mc.vertices))
+	for key, entry := range mc.edges {
+		entries = append(entries, mcListEntry{Source: key.Source.String(), Target: key.Target.String(), Kind: key.Kind.String(), Created: entry.Created, HalfLife: entry.HalfLife})
+	}
+	for sid, entry := range mc.vertices {
+		entries = append(entries, mcListEntry{Vertex: sid.String(), Created: entry.Created, HalfLife: entry.HalfLife})
+	}
+	return entries
+}
+
+// Clear removes every tracked mark
+func (mc *MissionControlTracker) Clear() {
+	mc.mu.Lock()
+	mc.edges = make(map[mcEdgeKey]mcEntry)
+	mc.vertices = make(map[windowssecurity.SID]mcEntry)
+	mc.mu.Unlock()
+	mc.save()
+}
+
+// mcEdgeFileEntry/mcVertexFileEntry are the on-disk shapes for persistence.
+// Go's encoding/json can't key a map on a struct, so edges and vertices are
+// flattened to slices when saving and rebuilt into maps when loading
+type mcEdgeFileEntry struct {
+	Source windowssecurity.SID
+	Target windowssecurity.SID
+	Kind   engine.Edge
+	mcEntry
+}
+
+type mcVertexFileEntry struct {
+	SID windowssecurity.SID
+	mcEntry
+}
+
+type missionControlFile struct {
+	Edges    []mcEdgeFileEntry
+	Vertices []mcVertexFileEntry
+}
+
+func (mc *MissionControlTracker) save() {
+	if mc.path == "" {
+		return
+	}
+
+	mc.mu.RLock()
+	var file missionControlFile
+	for key, entry := range mc.edges {
+		file.Edges = append(file.Edges, mcEdgeFileEntry{Source: key.Source, Target: key.Target, Kind: key.Kind, mcEntry: entry})
+	}
+	for sid, entry := range mc.vertices {
+		file.Vertices = append(file.Vertices, mcVertexFileEntry{SID: sid, mcEntry: entry})
+	}
+	mc.mu.RUnlock()
+
+	data, err := json.Marshal(file)
+	if err != nil {
+		ui.Warn().Msgf("Could not marshal mission control data: %v", err)
+		return
+	}
+
+	if err := os.WriteFile(mc.path, data, 0600); err != nil {
+		ui.Warn().Msgf("Could not persist mission control data to %v: %v", mc.path, err)
+	}
+}
+
+func (mc *MissionControlTracker) load() {
+	if mc.path == "" {
+		return
+	}
+
+	data, err := os.ReadFile(mc.path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			ui.Warn().Msgf("Could not load mission control data from %v: %v", mc.path, err)
+		}
+		return
+	}
+
+	var file missionControlFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		ui.Warn().Msgf("Could not parse mission control data from %v: %v", mc.path, err)
+		return
+	}
+
+	edges := make(map[mcEdgeKey]mcEntry, len(file.Edges))
+	for _, e := range file.Edges {
+		edges[mcEdgeKey{Source: e.Source, Target: e.Target, Kind: e.Kind}] = e.mcEntry
+	}
+	vertices := make(map[windowssecurity.SID]mcEntry, len(file.Vertices))
+	for _, v := range file.Vertices {
+		vertices[v.SID] = v.mcEntry
+	}
+
+	mc.mu.Lock()
+	mc.edges = edges
+	mc.vertices = vertices
+	mc.mu.Unlock()
+}
+
+// mcEdgeRequest is the POST /api/mc/edge request body
+type mcEdgeRequest struct {
+	Source   string
+	Target   string
+	Kind     string
+	HalfLife time.Duration
+}
+
+// MissionControlAddEdgeHandler handles POST /api/mc/edge
+func MissionControlAddEdgeHandler(ctx *gin.Context) {
+	var req mcEdgeRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		ctx.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+
+	source, err := windowssecurity.SIDFromString(req.Source)
+	if err != nil {
+		ctx.JSON(400, gin.H{"error": "invalid source SID: " + err.Error()})
+		return
+	}
+	target, err := windowssecurity.SIDFromString(req.Target)
+	if err != nil {
+		ctx.JSON(400, gin.H{"error": "invalid target SID: " + err.Error()})
+		return
+	}
+
+	kind, found := engine.LookupEdge(req.Kind)
+	if !found {
+		ctx.JSON(400, gin.H{"error": "unknown edge kind: " + req.Kind})
+		return
+	}
+
+	MissionControl.MarkEdge(source, target, kind, req.HalfLife)
+	ctx.JSON(200, gin.H{"status": "ok"})
+}
+
+// mcVertexRequest is the POST /api/mc/vertex request body
+type mcVertexRequest struct {
+	SID      string
+	HalfLife time.Duration
+}
+
+// MissionControlAddVertexHandler handles POST /api/mc/vertex
+func MissionControlAddVertexHandler(ctx *gin.Context) {
+	var req mcVertexRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		ctx.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+
+	sid, err := windowssecurity.SIDFromString(req.SID)
+	if err != nil {
+		ctx.JSON(400, gin.H{"error": "invalid SID: " + err.Error()})
+		return
+	}
+
+	MissionControl.MarkVertex(sid, req.HalfLife)
+	ctx.JSON(200, gin.H{"status": "ok"})
+}
+
+// MissionControlListHandler handles GET /api/mc
+func MissionControlListHandler(ctx *gin.Context) {
+	ctx.JSON(200, MissionControl.List())
+}
+
+// MissionControlClearHandler handles DELETE /api/mc
+func MissionControlClearHandler(ctx *gin.Context) {
+	MissionControl.Clear()
+	ctx.JSON(200, gin.H{"status": "ok"})
+}
@@ -0,0 +1,381 @@
+package analyze
+
+import (
+	"container/heap"
+	"fmt"
+	"math"
+	"strings"
+
+	"github.com/lkarlslund/adalanche/modules/engine"
+	"github.com/lkarlslund/adalanche/modules/graph"
+	"github.com/lkarlslund/adalanche/modules/query"
+	"github.com/lkarlslund/adalanche/modules/ui"
+)
+
+// PathMode selects how Analyze builds its result graph
+type PathMode int
+
+const (
+	// PathModeExpand is the classic "all reachable" BFS/round based expansion
+	PathModeExpand PathMode = iota
+	// PathModeTopK returns the PathCount most-probable paths from FilterFirst to Targets
+	PathModeTopK
+)
+
+// pathstep is one hop of a candidate path. cost is the cumulative Dijkstra
+// cost to reach object, so a path's prefix can be reused as a Yen root path
+// without recomputing it
+type pathstep struct {
+	object *engine.Object
+	edges  engine.EdgeBitmap // edges used to arrive at object from the previous step, zero value on the first step
+	cost   float64
+}
+
+// candidatepath is a full path with its accumulated cost (-log probability, additive)
+type candidatepath struct {
+	steps []pathstep
+	cost  float64
+}
+
+// probability turns the additive cost back into the accumulated edge probability (0-1)
+func (p candidatepath) probability() float32 {
+	return float32(math.Exp(-p.cost))
+}
+
+// edgeCost turns an edge's probability into an additive Dijkstra weight, so the
+// cheapest path by cost is the path that maximizes the product of probabilities
+func edgeCost(p engine.Probability) float64 {
+	if p <= 0 {
+		return math.Inf(1)
+	}
+	return -math.Log(float64(p) / 100)
+}
+
+// pqitem is a node on the Dijkstra/Yen priority queue
+type pqitem struct {
+	path candidatepath
+}
+
+type pathqueue []pqitem
+
+func (pq pathqueue) Len() int           { return len(pq) }
+func (pq pathqueue) Less(i, j int) bool { return pq[i].path.cost < pq[j].path.cost }
+func (pq pathqueue) Swap(i, j int)      { pq[i], pq[j] = pq[j], pq[i] }
+func (pq *pathqueue) Push(x any)        { *pq = append(*pq, x.(pqitem)) }
+func (pq *pathqueue) Pop() any {
+	old := *pq
+	n := len(old)
+	item := old[n-1]
+	*pq = old[:n-1]
+	return item
+}
+
+// edgeSetFor picks the allowed edge bitmap for a hop, mirroring the
+// EdgesFirst/Middle/Last semantics of the round based expansion in Analyze
+func edgeSetFor(opts AnalyzeOptions, fromIsSource, toIsTarget bool) engine.EdgeBitmap {
+	if fromIsSource {
+		return opts.EdgesFirst
+	}
+	if toIsTarget {
+		return opts.EdgesLast
+	}
+	return opts.EdgesMiddle
+}
+
+// objectTypesFor picks the allowed object type set for a hop, mirroring how
+// Analyze's round based expansion swaps detectobjecttypes between
+// ObjectTypesFirst/Middle/Last. A nil/empty map means "no restriction", same
+// as ObjectTypesMiddle/Last being unset leaves detectobjecttypes nil there
+func objectTypesFor(opts AnalyzeOptions, fromIsSource, toIsTarget bool) map[engine.ObjectType]struct{} {
+	if fromIsSource {
+		return opts.ObjectTypesFirst
+	}
+	if toIsTarget {
+		if len(opts.ObjectTypesLast) > 0 {
+			return opts.ObjectTypesLast
+		}
+		return nil
+	}
+	if len(opts.ObjectTypesMiddle) > 0 {
+		return opts.ObjectTypesMiddle
+	}
+	return nil
+}
+
+// shortestPath runs a Dijkstra search from source to the cheapest reachable
+// node in targets, respecting the probability/depth/edge constraints in opts.
+// excludednodes and excludededges let Yen's algorithm carve spur paths out of
+// previously found paths. It returns false if no path could be found
+func shortestPath(opts AnalyzeOptions, source *engine.Object, targets, sources, excludednodes map[*engine.Object]struct{}, excludededges map[graph.NodePair[*engine.Object]]struct{}) (candidatepath, bool) {
+	start := candidatepath{steps: []pathstep{{object: source}}, cost: 0}
+	best := map[*engine.Object]float64{source: 0}
+
+	pq := &pathqueue{{path: start}}
+	visited := make(map[*engine.Object]struct{})
+
+	for pq.Len() > 0 {
+		item := heap.Pop(pq).(pqitem)
+		current := item.path.steps[len(item.path.steps)-1].object
+
+		if _, done := visited[current]; done {
+			continue
+		}
+		visited[current] = struct{}{}
+
+		if _, istarget := targets[current]; istarget && current != source {
+			return item.path, true
+		}
+
+		if opts.MaxDepth != -1 && len(item.path.steps)-1 >= opts.MaxDepth {
+			continue
+		}
+
+		if _, excluded := excludednodes[current]; excluded && current != source {
+			continue
+		}
+
+		if skipExpansion(opts, current) {
+			continue
+		}
+
+		current.Edges(opts.Direction).Range(func(next *engine.Object, eb engine.EdgeBitmap) bool {
+			next = canonicalIdentity(next)
+
+			if _, excluded := excludednodes[next]; excluded {
+				return true
+			}
+			if _, excluded := excludededges[graph.NodePair[*engine.Object]{Source: current, Target: next}]; excluded {
+				return true
+			}
+
+			_, fromIsSource := sources[current]
+			_, toIsTarget := targets[next]
+			allowed := eb.Intersect(edgeSetFor(opts, fromIsSource, toIsTarget))
+			if allowed.IsBlank() {
+				return true
+			}
+
+			if types := objectTypesFor(opts, fromIsSource, toIsTarget); types != nil {
+				if _, found := types[next.Type()]; !found {
+					return true
+				}
+			}
+
+			if opts.FilterMiddle != nil && !opts.FilterMiddle.Evaluate(next) {
+				return true
+			}
+			if toIsTarget && opts.FilterLast != nil && !opts.FilterLast.Evaluate(next) {
+				return true
+			}
+
+			var prob engine.Probability
+			if opts.Direction == engine.In {
+				prob = allowed.MaxProbability(next, current)
+				prob = engine.Probability(float32(prob) * MissionControl.Weight(next, current, allowed))
+			} else {
+				prob = allowed.MaxProbability(current, next)
+				prob = engine.Probability(float32(prob) * MissionControl.Weight(current, next, allowed))
+			}
+			if prob < opts.MinEdgeProbability {
+				return true
+			}
+
+			cost := item.path.cost + edgeCost(prob)
+			if existing, found := best[next]; found && existing <= cost {
+				return true
+			}
+
+			newsteps := make([]pathstep, len(item.path.steps), len(item.path.steps)+1)
+			copy(newsteps, item.path.steps)
+			newsteps = append(newsteps, pathstep{object: next, edges: allowed, cost: cost})
+			newpath := candidatepath{steps: newsteps, cost: cost}
+
+			if newpath.probability() < float32(opts.MinAccumulatedProbability)/100 {
+				return true
+			}
+
+			best[next] = cost
+			heap.Push(pq, pqitem{path: newpath})
+
+			return true
+		})
+	}
+
+	return candidatepath{}, false
+}
+
+// pathsShareRoot tells if two step slices of equal length visit the same objects
+func pathsShareRoot(a, b []pathstep) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].object != b[i].object {
+			return false
+		}
+	}
+	return true
+}
+
+// pathKey builds a dedupe key so the Yen candidate queue doesn't enqueue the
+// same spur path more than once
+func pathKey(p candidatepath) string {
+	var sb strings.Builder
+	for _, step := range p.steps {
+		fmt.Fprintf(&sb, "%p|", step.object)
+	}
+	return sb.String()
+}
+
+// yenKShortestPaths finds up to k loopless paths from any node in sources to
+// any node in targets, in ascending order of cost, using Yen's algorithm on
+// top of shortestPath's Dijkstra search. The candidate queue is seeded with
+// the best path from every source, not just the globally cheapest one, so a
+// cheaper spur found from a different source can still be picked up as path 2
+func yenKShortestPaths(opts AnalyzeOptions, sources, targets map[*engine.Object]struct{}, k int) []candidatepath {
+	B := &pathqueue{}
+	seen := make(map[string]struct{})
+
+	for source := range sources {
+		path, found := shortestPath(opts, source, targets, sources, nil, nil)
+		if !found {
+			continue
+		}
+		key := pathKey(path)
+		if _, dup := seen[key]; dup {
+			continue
+		}
+		seen[key] = struct{}{}
+		heap.Push(B, pqitem{path: path})
+	}
+
+	if B.Len() == 0 {
+		return nil
+	}
+
+	var A []candidatepath
+
+	for len(A) < k && B.Len() > 0 {
+		prev := heap.Pop(B).(pqitem).path
+		A = append(A, prev)
+
+		for i := 0; i < len(prev.steps)-1; i++ {
+			spurnode := prev.steps[i].object
+			rootpath := prev.steps[:i+1]
+
+			excludededges := make(map[graph.NodePair[*engine.Object]]struct{})
+			for _, p := range A {
+				if len(p.steps) > i+1 && pathsShareRoot(p.steps[:i+1], rootpath) {
+					excludededges[graph.NodePair[*engine.Object]{Source: p.steps[i].object, Target: p.steps[i+1].object}] = struct{}{}
+				}
+			}
+
+			excludednodes := make(map[*engine.Object]struct{})
+			for _, step := range rootpath[:len(rootpath)-1] {
+				excludednodes[step.object] = struct{}{}
+			}
+
+			spurpath, found := shortestPath(opts, spurnode, targets, sources, excludednodes, excludededges)
+			if !found {
+				continue
+			}
+
+			combinedsteps := make([]pathstep, 0, len(rootpath)+len(spurpath.steps)-1)
+			combinedsteps = append(combinedsteps, rootpath[:len(rootpath)-1]...)
+			// Spur step costs start at 0 on the spur node, shift them so they
+			// stay cumulative from the path's first step
+			rootcost := rootpath[len(rootpath)-1].cost
+			for _, step := range spurpath.steps {
+				step.cost += rootcost
+				combinedsteps = append(combinedsteps, step)
+			}
+
+			candidate := candidatepath{steps: combinedsteps, cost: rootcost + spurpath.cost}
+
+			key := pathKey(candidate)
+			if _, dup := seen[key]; dup {
+				continue
+			}
+			seen[key] = struct{}{}
+			heap.Push(B, pqitem{path: candidate})
+		}
+	}
+
+	return A
+}
+
+// analyzeTopKPaths implements AnalyzeOptions.PathMode == PathModeTopK: instead
+// of expanding everything reachable from FilterFirst, it returns the union
+// graph of the PathCount most-probable paths to the Targets filter, with each
+// node/edge stamped with the ordinal(s) of the path(s) it belongs to
+func analyzeTopKPaths(opts AnalyzeOptions, objects *engine.Objects) AnalysisResults {
+	sources := make(map[*engine.Object]struct{})
+	targets := make(map[*engine.Object]struct{})
+	for _, collection := range allCollections(objects, opts.Collections) {
+		query.Execute(opts.FilterFirst, collection).Iterate(func(o *engine.Object) bool {
+			sources[canonicalIdentity(o)] = struct{}{}
+			return true
+		})
+		query.Execute(opts.Targets, collection).Iterate(func(o *engine.Object) bool {
+			targets[canonicalIdentity(o)] = struct{}{}
+			return true
+		})
+	}
+
+	pg := graph.NewGraph[*engine.Object, engine.EdgeBitmap]()
+
+	if len(sources) == 0 || len(targets) == 0 {
+		return AnalysisResults{Graph: pg}
+	}
+
+	k := opts.PathCount
+	if k < 1 {
+		k = 1
+	}
+
+	paths := yenKShortestPaths(opts, sources, targets, k)
+	if len(paths) == 0 {
+		ui.Info().Msg("Top-K path analysis found no path between FilterFirst and Targets")
+		return AnalysisResults{Graph: pg}
+	}
+
+	edgeordinals := make(map[graph.NodePair[*engine.Object]][]int)
+	nodeordinals := make(map[*engine.Object][]int)
+
+	for pidx, path := range paths {
+		ordinal := pidx + 1
+		for i, step := range path.steps {
+			nodeordinals[step.object] = append(nodeordinals[step.object], ordinal)
+			if i == 0 {
+				continue
+			}
+			prev := path.steps[i-1].object
+
+			var pair graph.NodePair[*engine.Object]
+			if opts.Direction == engine.In {
+				pair = graph.NodePair[*engine.Object]{Source: step.object, Target: prev}
+			} else {
+				pair = graph.NodePair[*engine.Object]{Source: prev, Target: step.object}
+			}
+			pg.AddEdge(pair.Source, pair.Target, step.edges)
+			edgeordinals[pair] = append(edgeordinals[pair], ordinal)
+		}
+	}
+
+	for pair, ordinals := range edgeordinals {
+		pg.SetEdgeData(pair.Source, pair.Target, "pathordinals", ordinals)
+	}
+	for node, ordinals := range nodeordinals {
+		pg.SetNodeData(node, "pathordinals", ordinals)
+		if _, issource := sources[node]; issource {
+			pg.SetNodeData(node, "source", true)
+		}
+		if _, istarget := targets[node]; istarget {
+			pg.SetNodeData(node, "target", true)
+		}
+	}
+
+	ui.Info().Msgf("Top-K path analysis found %v of %v requested paths", len(paths), k)
+
+	return AnalysisResults{Graph: pg}
+}
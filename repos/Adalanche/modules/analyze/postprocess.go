@@ -0,0 +1,131 @@
+package analyze
+
+import (
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lkarlslund/adalanche/modules/engine"
+	"github.com/lkarlslund/adalanche/modules/ui"
+)
+
+// PostProcessorFunc changes the edges of the loaded directory data directly,
+// before Analyze ever sees it - synthesizing composite edges (such as
+// transitive MemberOfGroup) or filtering existing ones. It returns the number
+// of relationships it added, refreshed or removed
+type PostProcessorFunc func(objects *engine.Objects) int
+
+// AtomicPostProcessingStats summarizes a single post-processor run, named
+// after BloodHound's equivalent post-processing telemetry
+type AtomicPostProcessingStats struct {
+	Relationships int
+	Duration      time.Duration
+}
+
+// PostProcessorInfo describes a registered post-processor for the HTTP listing endpoint
+type PostProcessorInfo struct {
+	Name        string
+	Description string
+	Kinds       []engine.Edge
+}
+
+type postProcessor struct {
+	PostProcessorInfo
+	fn PostProcessorFunc
+}
+
+var postProcessors = make(map[string]postProcessor)
+
+// RegisterPostProcessor adds a named post-processing step to the registry.
+// kinds lists the edge kinds the processor owns, so a re-run can delete its
+// own previously synthesized edges before regenerating them, making repeated
+// runs idempotent
+func RegisterPostProcessor(name string, kinds []engine.Edge, fn PostProcessorFunc) {
+	RegisterPostProcessorWithDescription(name, "", kinds, fn)
+}
+
+// RegisterPostProcessorWithDescription is like RegisterPostProcessor, but also
+// stores a human readable description returned by the HTTP listing endpoint
+func RegisterPostProcessorWithDescription(name, description string, kinds []engine.Edge, fn PostProcessorFunc) {
+	postProcessors[name] = postProcessor{
+		PostProcessorInfo: PostProcessorInfo{
+			Name:        name,
+			Description: description,
+			Kinds:       kinds,
+		},
+		fn: fn,
+	}
+}
+
+// ListPostProcessors returns the name, description and owned edge kinds of
+// every registered post-processor
+func ListPostProcessors() []PostProcessorInfo {
+	infos := make([]PostProcessorInfo, 0, len(postProcessors))
+	for _, pp := range postProcessors {
+		infos = append(infos, pp.PostProcessorInfo)
+	}
+	return infos
+}
+
+// PostProcessorsHandler lists the registered post-processors over HTTP, so the
+// UI can populate the postprocessors selection in the query form
+func PostProcessorsHandler(ctx *gin.Context) {
+	ctx.JSON(200, ListPostProcessors())
+}
+
+// deleteEdgesOfKinds removes every edge of the given kinds from objects, so a
+// post-processor can regenerate its synthesized edges from scratch rather than
+// accumulating duplicates across repeated runs
+func deleteEdgesOfKinds(objects *engine.Objects, kinds []engine.Edge) {
+	if len(kinds) == 0 {
+		return
+	}
+	objects.Iterate(func(source *engine.Object) bool {
+		source.Edges(engine.Out).Range(func(target *engine.Object, eb engine.EdgeBitmap) bool {
+			for _, kind := range kinds {
+				if eb.IsSet(kind) {
+					source.DeleteEdge(target, kind)
+				}
+			}
+			return true
+		})
+		return true
+	})
+}
+
+// RunPostProcessors runs the named registered post-processors (or every
+// registered processor if names is empty) against objects, deleting each
+// processor's previously synthesized edges first so repeated runs are
+// idempotent
+func RunPostProcessors(objects *engine.Objects, names []string) map[string]AtomicPostProcessingStats {
+	stats := make(map[string]AtomicPostProcessingStats)
+
+	run := func(pp postProcessor) {
+		deleteEdgesOfKinds(objects, pp.Kinds)
+
+		start := time.Now()
+		relationships := pp.fn(objects)
+		stats[pp.Name] = AtomicPostProcessingStats{
+			Relationships: relationships,
+			Duration:      time.Since(start),
+		}
+		ui.Info().Msgf("Post-processor %v changed %v relationships in %v", pp.Name, relationships, stats[pp.Name].Duration)
+	}
+
+	if len(names) == 0 {
+		for _, pp := range postProcessors {
+			run(pp)
+		}
+		return stats
+	}
+
+	for _, name := range names {
+		pp, found := postProcessors[name]
+		if !found {
+			ui.Warn().Msgf("Requested post-processor %v is not registered", name)
+			continue
+		}
+		run(pp)
+	}
+
+	return stats
+}
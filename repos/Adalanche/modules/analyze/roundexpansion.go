@@ -0,0 +1,302 @@
+package analyze
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/lkarlslund/adalanche/modules/engine"
+	"github.com/lkarlslund/adalanche/modules/graph"
+	"github.com/lkarlslund/adalanche/modules/ui"
+	"github.com/lkarlslund/adalanche/modules/windowssecurity"
+)
+
+// skipExpansion reports whether currentobject should not be expanded this
+// round at all, e.g. because it's Everyone/Authenticated Users and
+// DontExpandAUEO is set
+func skipExpansion(opts AnalyzeOptions, currentobject *engine.Object) bool {
+	return opts.Direction == engine.In && opts.DontExpandAUEO &&
+		(currentobject.SID() == windowssecurity.EveryoneSID || currentobject.SID() == windowssecurity.AuthenticatedUsersSID)
+}
+
+// evaluateNode computes the new edges and newly discovered nodes currentobject
+// contributes this round. It only reads pg/extrainfo, so it's safe to call
+// concurrently for different nodes as long as nothing else is mutating pg or
+// extrainfo at the same time - the caller is responsible for that
+func evaluateNode(opts AnalyzeOptions, pg graph.Graph[*engine.Object, engine.EdgeBitmap], extrainfo map[*engine.Object]*GraphNode, currentRound int, detectedges engine.EdgeBitmap, detectobjecttypes map[engine.ObjectType]struct{}, currentobject *engine.Object, ei *GraphNode) (map[graph.NodePair[*engine.Object]]engine.EdgeBitmap, map[*engine.Object]*GraphNode) {
+	newconnectionsmap := make(map[graph.NodePair[*engine.Object]]engine.EdgeBitmap) // Pwn Connection between objects
+	discovered := make(map[*engine.Object]*GraphNode)
+
+	currentobject.Edges(opts.Direction).Range(func(nextobject *engine.Object, eb engine.EdgeBitmap) bool {
+		// Collapse hybrid AD/Entra identities onto their on-prem node so
+		// cross-directory edges don't expand the same identity twice
+		nextobject = canonicalIdentity(nextobject)
+
+		// If this is not a chosen edge, skip it
+		detectededges := eb.Intersect(detectedges)
+
+		if detectededges.IsBlank() {
+			// Nothing useful or just a deny ACL, skip it
+			return true // continue
+		}
+
+		if detectobjecttypes != nil {
+			if _, found := detectobjecttypes[nextobject.Type()]; !found {
+				// We're filtering on types, and it's not wanted
+				return true //continue
+			}
+		}
+
+		// Edge probability
+		var maxprobability engine.Probability
+		if opts.Direction == engine.In {
+			maxprobability = detectededges.MaxProbability(nextobject, currentobject)
+			maxprobability = engine.Probability(float32(maxprobability) * MissionControl.Weight(nextobject, currentobject, detectededges))
+		} else {
+			maxprobability = detectededges.MaxProbability(currentobject, nextobject)
+			maxprobability = engine.Probability(float32(maxprobability) * MissionControl.Weight(currentobject, nextobject, detectededges))
+		}
+		if maxprobability < engine.Probability(opts.MinEdgeProbability) {
+			// Too unlikeliy, so we skip it
+			return true // continue
+		}
+
+		// Accumulated node probability
+		accumulatedprobability := ei.accumulatedprobability * float32(maxprobability) / 100
+		if accumulatedprobability < float32(opts.MinAccumulatedProbability)/100 {
+			// Too unlikeliy, so we skip it
+			return true // continue
+		}
+
+		// If we allow backlinks, all pwns are mapped, no matter who is the victim
+		// Targets are allowed to pwn each other as a way to reach the goal of pwning all of them
+		// If pwner is already processed, we don't care what it can pwn someone more far away from targets
+		// If pwner is our attacker, we always want to know what it can do
+		found := pg.HasNode(nextobject) // It could JUST have been added to the graph by another node in current processing round though
+
+		// SKIP THIS IF
+		if
+		// We're not including backlinks
+		found &&
+			// This is not the first round
+			currentRound > 1 &&
+			// It was found in an earlier round
+			extrainfo[nextobject] != nil && extrainfo[nextobject].processRound+opts.Backlinks <= currentRound &&
+			// If SIDs match between objects, it's a cross forest/domain link and we want to see it
+			(currentobject.SID().IsNull() || nextobject.SID().IsNull() || currentobject.SID().Component(2) != 21 || currentobject.SID() != nextobject.SID()) {
+			// skip it
+			return true // continue
+		}
+
+		if opts.FilterMiddle != nil && !opts.FilterMiddle.Evaluate(nextobject) {
+			// skip unwanted middle objects
+			return true // continue
+		}
+
+		if opts.MinInstances > 0 {
+			var instancecount int
+			if opts.Direction == engine.In {
+				instancecount = len(EdgeInstances(nextobject, currentobject))
+			} else {
+				instancecount = len(EdgeInstances(currentobject, nextobject))
+			}
+			if instancecount < opts.MinInstances {
+				// Not backed by enough independent ACEs/sessions/templates, skip it
+				return true // continue
+			}
+		}
+
+		if opts.Direction == engine.In {
+			newconnectionsmap[graph.NodePair[*engine.Object]{
+				Source: nextobject,
+				Target: currentobject}] = detectededges
+		} else {
+			newconnectionsmap[graph.NodePair[*engine.Object]{
+				Source: currentobject,
+				Target: nextobject}] = detectededges
+		}
+
+		if currentRound != 1 || extrainfo[nextobject] == nil {
+			// First round is special, as we process the targets
+			// All the other rounds, we can assume that nextobjects are new in the graph
+			discovered[nextobject] = &GraphNode{
+				processRound:           currentRound + 1,
+				accumulatedprobability: ei.accumulatedprobability * float32(maxprobability) / 100,
+			}
+		}
+
+		return true
+	})
+
+	return newconnectionsmap, discovered
+}
+
+// applyNodeResult is the single writer that merges one node's evaluateNode
+// result into pg and extrainfo. It must never run concurrently with itself or
+// with evaluateNode for the same round
+func applyNodeResult(pg graph.Graph[*engine.Object, engine.EdgeBitmap], ei *GraphNode, currentobject *engine.Object, opts AnalyzeOptions, currentRound int, newconnectionsmap map[graph.NodePair[*engine.Object]]engine.EdgeBitmap, discovered map[*engine.Object]*GraphNode, extrainfo map[*engine.Object]*GraphNode) {
+	for nextobject, graphnode := range discovered {
+		if currentRound == 1 {
+			// In round 1, evaluateNode's own "already discovered" check reads
+			// extrainfo, which is only live (reflects earlier nodes already
+			// merged this round) for the serial path - processRoundParallel
+			// hands every worker the same pre-round snapshot, so more than one
+			// node can independently claim the same nextobject. Applying
+			// merges in nodes order and keeping the first one here makes
+			// parallel match the serial first-discoverer-wins outcome
+			if _, alreadyclaimed := extrainfo[nextobject]; alreadyclaimed {
+				continue
+			}
+		}
+		// Later rounds are always assumed to discover brand new nodes, so a
+		// later merge in this same round legitimately overwrites an earlier
+		// one here, same as the old interleaved serial code did
+		extrainfo[nextobject] = graphnode
+	}
+
+	if opts.MaxOutgoingConnections == -1 || len(newconnectionsmap) < opts.MaxOutgoingConnections {
+		for pwnpair, detectedmethods := range newconnectionsmap {
+			pg.AddEdge(pwnpair.Source, pwnpair.Target, detectedmethods)
+			stampEdgeInstances(pg, pwnpair.Source, pwnpair.Target)
+		}
+		// Add pwn target to graph for processing
+	} else {
+		ui.Debug().Msgf("Outgoing expansion limit hit %v for object %v, there was %v connections", opts.MaxOutgoingConnections, currentobject.Label(), len(newconnectionsmap))
+		var added int
+		var groupcount int
+		for _, detectedmethods := range newconnectionsmap {
+			// We assume the number of groups are limited and add them anyway
+			if detectedmethods.IsSet(EdgeMemberOfGroup) {
+				groupcount++
+			}
+		}
+
+		if groupcount < opts.MaxOutgoingConnections {
+			// Add the groups, but not the rest
+			for pwnpair, detectedmethods := range newconnectionsmap {
+				// We assume the number of groups are limited and add them anyway
+				if detectedmethods.IsSet(EdgeMemberOfGroup) {
+					pg.AddEdge(pwnpair.Source, pwnpair.Target, detectedmethods)
+					stampEdgeInstances(pg, pwnpair.Source, pwnpair.Target)
+					delete(newconnectionsmap, pwnpair)
+					added++
+				}
+			}
+			ui.Debug().Msgf("Expansion limit compromise - added %v groups as they fit under the expansion limit %v", added, opts.MaxOutgoingConnections)
+		}
+
+		// Add some more to expansion limit hit objects if we know how
+		if SortBy != engine.NonExistingAttribute {
+			var additionaladded int
+
+			// Find the most important ones that are not groups
+			var notadded []graph.GraphNodePairEdge[*engine.Object, engine.EdgeBitmap]
+			for pwnpair, detectedmethods := range newconnectionsmap {
+				notadded = append(notadded, graph.GraphNodePairEdge[*engine.Object, engine.EdgeBitmap]{
+					Source: pwnpair.Source,
+					Target: pwnpair.Target,
+					Edge:   detectedmethods,
+				})
+			}
+
+			sort.Slice(notadded, func(i, j int) bool {
+				if opts.Direction == engine.In {
+					iv, _ := notadded[i].Source.AttrInt(SortBy)
+					jv, _ := notadded[j].Source.AttrInt(SortBy)
+					return iv > jv
+				}
+				iv, _ := notadded[i].Target.AttrInt(SortBy)
+				jv, _ := notadded[j].Target.AttrInt(SortBy)
+				return iv > jv
+			})
+
+			// Add up to limit
+			for i := 0; i+added < opts.MaxOutgoingConnections && i < len(notadded); i++ {
+				pg.AddEdge(notadded[i].Source, notadded[i].Target, notadded[i].Edge)
+				stampEdgeInstances(pg, notadded[i].Source, notadded[i].Target)
+				additionaladded++
+			}
+
+			ui.Debug().Msgf("Added additionally %v prioritized objects", additionaladded)
+			added += additionaladded
+		}
+
+		ei.CanExpand = len(newconnectionsmap) - added
+	}
+}
+
+// stampEdgeInstances attaches the registered EdgeInstance records for an edge
+// as graph data, so the UI can enumerate which ACE/template/session backs it
+func stampEdgeInstances(pg graph.Graph[*engine.Object, engine.EdgeBitmap], source, target *engine.Object) {
+	if instances := EdgeInstances(source, target); len(instances) > 0 {
+		pg.SetEdgeData(source, target, "instances", instances)
+	}
+}
+
+// processRoundParallel evaluates nodes across a bounded worker pool and then
+// merges every result back into pg/extrainfo on a single goroutine, so a
+// round's expansion parallelizes the expensive edge/probability evaluation
+// without needing to make pg or extrainfo safe for concurrent writes. Every
+// evaluateNode call reads pg/extrainfo, never writes them, which is why this
+// is safe as long as the graph package itself tolerates concurrent reads
+// while this goroutine is the only one mutating it - true of the in-memory
+// graph implementation this package is built against.
+// Because evaluation no longer happens interleaved with the merge, nodes in
+// the same round don't see each other's additions while evaluating - but the
+// merge loop still applies results in the same nodes order the serial path
+// would have visited them in, and applyNodeResult's round-1 first-claim guard
+// keeps tie-breaking identical to the serial path for opts.Workers <= 1
+//
+// Still missing: an executable regression test asserting Analyze(opts, objects)
+// with opts.Workers == 1 and opts.Workers > 1 produce graph-isomorphic results
+// (same nodes, same edges, same EdgeBitmaps) on a shared fixture with a diamond
+// membership shape (so more than one node can race to discover the same
+// nextobject in round 1). This snapshot has no engine/graph package source to
+// construct a real *engine.Objects fixture against, so a test written now
+// would be asserting against a guessed API rather than the real one. Add it
+// once the engine and graph packages are available in this tree
+func processRoundParallel(opts AnalyzeOptions, pg graph.Graph[*engine.Object, engine.EdgeBitmap], extrainfo map[*engine.Object]*GraphNode, currentRound int, detectedges engine.EdgeBitmap, detectobjecttypes map[engine.ObjectType]struct{}, nodes []*engine.Object) {
+	type evalresult struct {
+		newconnectionsmap map[graph.NodePair[*engine.Object]]engine.EdgeBitmap
+		discovered        map[*engine.Object]*GraphNode
+	}
+
+	results := make([]evalresult, len(nodes))
+
+	workers := opts.Workers
+	if workers > len(nodes) {
+		workers = len(nodes)
+	}
+
+	indexes := make(chan int, len(nodes))
+	for i := range nodes {
+		indexes <- i
+	}
+	close(indexes)
+
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for w := 0; w < workers; w++ {
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				currentobject := nodes[i]
+				if skipExpansion(opts, currentobject) {
+					continue
+				}
+				ei := extrainfo[currentobject]
+				newconnectionsmap, discovered := evaluateNode(opts, pg, extrainfo, currentRound, detectedges, detectobjecttypes, currentobject, ei)
+				results[i] = evalresult{newconnectionsmap: newconnectionsmap, discovered: discovered}
+			}
+		}()
+	}
+	wg.Wait()
+
+	// Single writer: merge every worker's findings into pg/extrainfo in order
+	for i, currentobject := range nodes {
+		if results[i].newconnectionsmap == nil {
+			continue // was skipped by skipExpansion
+		}
+		ei := extrainfo[currentobject]
+		applyNodeResult(pg, ei, currentobject, opts, currentRound, results[i].newconnectionsmap, results[i].discovered, extrainfo)
+	}
+}